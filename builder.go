@@ -3,6 +3,7 @@ package custombuild
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"go/parser"
@@ -20,6 +21,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/wheelq/custombuild/codegen"
 	"golang.org/x/tools/go/ast/astutil"
 )
 
@@ -35,6 +37,13 @@ type Builder struct {
 	// The function that can change the code to prepare a custom build
 	Generator CodeGenFunc
 
+	// GeneratorV2 does the same job as Generator but through a
+	// *codegen.GenContext, so it can express imports, //go:embed
+	// directives and init statements via AddImport/EmbedFile/AppendInit
+	// instead of hand-rolling astutil calls. It runs after Generator,
+	// if both are set.
+	GeneratorV2 CodeGenFuncV2
+
 	// The list of packages required for this custom build
 	Packages []string
 
@@ -54,13 +63,45 @@ type Builder struct {
 	// If empty, topmost package is built.
 	SubPackage string
 
+	// Modules forces Go modules mode even if RepoPath does not contain
+	// a go.mod file, in which case Setup runs `go mod init` in the repo
+	// copy first, using ModulePath (or, if empty, the base name of
+	// RepoPath) as the module path. If RepoPath does contain a go.mod,
+	// modules mode is used automatically regardless of this field, and
+	// ModulePath is ignored.
+	Modules bool
+
+	// ModulePath is the module path passed to `go mod init` when Modules
+	// is set but RepoPath has no go.mod of its own. Ignored otherwise.
+	ModulePath string
+
+	// CacheDir is the directory used to cache built binaries, keyed by
+	// a hash of the build inputs, and to hold a GOCACHE shared across
+	// builds so incremental compiles reuse Go's own build cache instead
+	// of starting cold. If empty, defaults to a "custombuild"
+	// subdirectory under os.UserCacheDir().
+	CacheDir string
+
+	// Reproducible makes the build pass -trimpath (so the random temp
+	// repoCopy path doesn't leak into the binary and change its hash
+	// across runs) and -buildvcs=false when the repo copy isn't itself
+	// a VCS checkout. Combine with a SOURCE_DATE_EPOCH environment
+	// variable, which Setup then honors by normalizing the repo copy's
+	// file mtimes, for byte-identical output across machines.
+	Reproducible bool
+
+	// BuildID, when Reproducible is set and BuildID is non-empty, is
+	// passed as -ldflags "-buildid=<BuildID>" to pin a deterministic
+	// build ID instead of the one `go build` would otherwise derive.
+	BuildID string
+
 	// Length of time on average to allow each package during go get -u
 	timePerPackage time.Duration
 
 	// Path to temporary folder of the copy of the repository
 	repoCopy string
 
-	// GOPATH to use for Generator
+	// GOPATH to use for Generator. Only set in GOPATH mode.
 	goPath string
 
 	// Flag to check if -u should be used with go get
@@ -69,6 +110,15 @@ type Builder struct {
 	// Flag to ensure setup only occurs once
 	ready bool
 
+	// Whether Setup resolved this build to modules mode
+	modules bool
+
+	// Resolved cache directories and the source-side component of the
+	// build cache key, set up by initCache at the end of Setup.
+	cacheDir   string
+	goCacheDir string
+	sourceHash string
+
 	// Environment variables
 	env Env
 }
@@ -106,14 +156,55 @@ func NewUnready(src string, codegen CodeGenFunc, dependencies []string) (Builder
 // Setup sets up the builder. It downloads/updates the packages and copies
 // the repository to a temporary directory, where code modifications occur.
 // This function is blocking. When it completes, if there is no error, it
-// is ready to produce builds.
+// is ready to produce builds. It is equivalent to SetupContext with
+// context.Background().
 func (b *Builder) Setup() error {
+	return b.SetupContext(context.Background())
+}
+
+// SetupContext is Setup with a context for cancellation. Cancelling ctx
+// kills any in-flight `go get`/`go mod` subprocess and aborts the repo
+// copy, cleanly tearing down the child process tree instead of leaking
+// it.
+func (b *Builder) SetupContext(ctx context.Context) error {
 	if b.ready {
 		return errors.New("already set up")
 	}
 
+	origHash, err := hashTree(b.RepoPath)
+	if err != nil {
+		return err
+	}
+
+	b.modules = b.Modules || fileExists(filepath.Join(b.RepoPath, "go.mod"))
+	if b.modules {
+		err = b.setupModules(ctx)
+	} else {
+		err = b.setupGOPATH(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if b.Reproducible {
+		if err := b.normalizeMtimes(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.initCache(origHash); err != nil {
+		return err
+	}
+
+	b.ready = true
+	return nil
+}
+
+// setupGOPATH performs Setup for a repository without a go.mod, using a
+// temporary GOPATH and `go get` as before modules existed.
+func (b *Builder) setupGOPATH(ctx context.Context) error {
 	// Run `go get -u` on the dependencies for this build
-	err := b.goGet(b.Packages)
+	err := b.goGetContext(ctx, b.Packages)
 	if err != nil {
 		return err
 	}
@@ -136,7 +227,7 @@ func (b *Builder) Setup() error {
 	}
 
 	// Copy the repository to temporary directory
-	err = DeepCopy(b.RepoPath, b.repoCopy)
+	err = DeepCopyContext(ctx, b.RepoPath, b.repoCopy)
 	if err != nil {
 		return err
 	}
@@ -148,11 +239,80 @@ func (b *Builder) Setup() error {
 			return err
 		}
 	}
+	if b.GeneratorV2 != nil {
+		if err := b.runGeneratorV2(); err != nil {
+			return err
+		}
+	}
 
-	b.ready = true
 	return nil
 }
 
+// setupModules performs Setup for a repository that has a go.mod (or has
+// Modules forced on). It copies the module tree as-is, preserving
+// go.mod/go.sum/vendor, mutates the code, then resolves dependencies with
+// `go get`/`go mod tidy`/`go mod download` instead of building a GOPATH.
+// SetImportPath and RewriteImports are not needed in this mode, since the
+// copy already has a working module path.
+func (b *Builder) setupModules(ctx context.Context) error {
+	dir, err := ioutil.TempDir("", fmt.Sprintf("custombuild_%d_", rand.Intn(9999)))
+	if err != nil {
+		return err
+	}
+	b.repoCopy = dir
+
+	// Copy the repository to temporary directory, preserving go.mod,
+	// go.sum and vendor/.
+	if err := DeepCopyContext(ctx, b.RepoPath, b.repoCopy); err != nil {
+		return err
+	}
+
+	// Make sure modules are on even if the ambient environment has
+	// GO111MODULE=off or =auto set and the copy is outside of GOPATH.
+	b.env.Set("GO111MODULE", "on")
+
+	// RepoPath had no go.mod of its own; Modules was set to force
+	// modules mode anyway, so give the copy one to build against.
+	if !fileExists(filepath.Join(b.RepoPath, "go.mod")) {
+		modulePath := b.ModulePath
+		if modulePath == "" {
+			modulePath = filepath.Base(b.RepoPath)
+		}
+		if err := b.runModCmdContext(ctx, []string{"mod", "init", modulePath}); err != nil {
+			return err
+		}
+	}
+
+	// Mutate the code
+	if b.Generator != nil {
+		if err := b.Generator(b.repoCopy, b.Packages); err != nil {
+			return err
+		}
+	}
+	if b.GeneratorV2 != nil {
+		if err := b.runGeneratorV2(); err != nil {
+			return err
+		}
+	}
+
+	// Resolve the dependencies for this build
+	if err := b.modGetContext(ctx, b.Packages); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// runGeneratorV2 runs GeneratorV2 against a fresh GenContext for the
+// repo copy and flushes its accumulated mutations to disk.
+func (b *Builder) runGeneratorV2() error {
+	genCtx := codegen.NewGenContext(b.repoCopy, b.Packages)
+	if err := b.GeneratorV2(genCtx); err != nil {
+		return err
+	}
+	return genCtx.Flush()
+}
+
 // UseNetworkForAll sets if network should be used to fetch all package dependencies
 // including previously fetched ones which basically uses -u flag for go get during Setup.
 // This defaults to true. To set to false, create builder with NewUnready and set this
@@ -164,18 +324,26 @@ func (b *Builder) UseNetworkForAll(useNetwork bool) {
 // goGet runs `go get` for all the packages in pkgs.
 // This function is blocking. If an error was returned, not all
 // packages were updated. The process will be killed if it
-// takes too long, which will then return an error.
+// takes too long, which will then return an error. It is equivalent to
+// goGetContext with context.Background().
 func (b *Builder) goGet(pkgs []string) error {
+	return b.goGetContext(context.Background(), pkgs)
+}
+
+// goGetContext is goGet with a context for cancellation, in addition to
+// the per-package timeout it already enforces.
+func (b *Builder) goGetContext(ctx context.Context, pkgs []string) error {
 	if len(pkgs) == 0 {
 		// nothing to do
 		return nil
 	}
 
-	// Set timeout
 	timeout := b.timePerPackage * time.Duration(len(pkgs))
 	if timeout == 0 {
 		timeout = defaultGoGetTimeout
 	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
 	// Prepare command
 	args := []string{"get", "-d"}
@@ -183,38 +351,67 @@ func (b *Builder) goGet(pkgs []string) error {
 		args = append(args, "-u", "-f")
 	}
 	args = append(args, pkgs...)
-	cmd := exec.Command("go", args...)
+	cmd := exec.CommandContext(ctx, "go", args...)
 	errBuf := new(bytes.Buffer)
 	cmd.Stderr = errBuf
 	cmd.Env = b.env
 
-	// Start process
-	err := cmd.Start()
-	if err != nil {
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errorFmt(cmd, errors.New("process killed: go get took too long"), errBuf)
+		}
 		return errorFmt(cmd, err, errBuf)
 	}
+	return nil
+}
 
-	// Wait for it to exit
-	done := make(chan error, 1) // buffer allows goroutine to exit immediately when cmd exits
-	go func() {
-		done <- cmd.Wait()
-	}()
+// modGet resolves dependencies for a modules-mode build. It runs `go get`
+// inside the repo copy for each requested package (each may be a bare
+// import path or "path@version", same as the go command accepts), then
+// tidies the module graph so the Generator's new imports are picked up;
+// both steps are skipped when pkgs is empty. It always downloads
+// everything so the build step never needs network access. It
+// is equivalent to modGetContext with context.Background().
+func (b *Builder) modGet(pkgs []string) error {
+	return b.modGetContext(context.Background(), pkgs)
+}
 
-	// Or kill the process if it runs too long
-	select {
-	case <-time.After(timeout):
-		err := cmd.Process.Kill()
-		<-done
-		if err != nil {
-			return errorFmt(cmd, err, errBuf)
+// modGetContext is modGet with a context for cancellation.
+func (b *Builder) modGetContext(ctx context.Context, pkgs []string) error {
+	if len(pkgs) > 0 {
+		args := append([]string{"get"}, pkgs...)
+		if err := b.runModCmdContext(ctx, args); err != nil {
+			return err
 		}
-		return errorFmt(cmd, errors.New("process killed: go get took too long"), errBuf)
-	case err := <-done:
-		if err != nil {
-			return errorFmt(cmd, err, errBuf)
+		if err := b.runModCmdContext(ctx, []string{"mod", "tidy"}); err != nil {
+			return err
 		}
 	}
+	return b.runModCmdContext(ctx, []string{"mod", "download"})
+}
+
+// runModCmdContext runs `go <args...>` inside the repo copy, subject to
+// the same per-package timeout as goGetContext, plus ctx.
+func (b *Builder) runModCmdContext(ctx context.Context, args []string) error {
+	timeout := b.timePerPackage * time.Duration(len(b.Packages))
+	if timeout == 0 {
+		timeout = defaultGoGetTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = b.repoCopy
+	errBuf := new(bytes.Buffer)
+	cmd.Stderr = errBuf
+	cmd.Env = b.env
 
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errorFmt(cmd, fmt.Errorf("process killed: go %s took too long", strings.Join(args, " ")), errBuf)
+		}
+		return errorFmt(cmd, err, errBuf)
+	}
 	return nil
 }
 
@@ -238,35 +435,68 @@ func (b *Builder) Teardown() error {
 	if !b.ready {
 		return errors.New("not set up")
 	}
+	if b.modules {
+		return os.RemoveAll(b.repoCopy)
+	}
 	return os.RemoveAll(b.goPath)
 }
 
 // Build does a custom build for goos and goarch. It plops the binary
 // at a file path specified by output. If goarch == "arm", the default
-// GOARM version is used.
+// GOARM version is used. It is equivalent to BuildContext with
+// context.Background().
 func (b *Builder) Build(goos, goarch, output string, args ...string) error {
-	return b.build(goos, goarch, "", output, false, args...)
+	return b.BuildContext(context.Background(), goos, goarch, output, args...)
+}
+
+// BuildContext is Build with a context for cancellation. Cancelling ctx
+// kills the in-flight `go build` subprocess cleanly instead of leaving
+// it running.
+func (b *Builder) BuildContext(ctx context.Context, goos, goarch, output string, args ...string) error {
+	return b.buildContext(ctx, goos, goarch, "", output, false, nil, args...)
 }
 
 // BuildARM does a custom ARM build for goos using the specified ARM version
-// in goarm. It plops the binary at a file path specified by output.
+// in goarm. It plops the binary at a file path specified by output. It is
+// equivalent to BuildARMContext with context.Background().
 func (b *Builder) BuildARM(goos string, goarm int, output string, args ...string) error {
-	return b.build(goos, "arm", strconv.Itoa(goarm), output, false, args...)
+	return b.BuildARMContext(context.Background(), goos, goarm, output, args...)
+}
+
+// BuildARMContext is BuildARM with a context for cancellation.
+func (b *Builder) BuildARMContext(ctx context.Context, goos string, goarm int, output string, args ...string) error {
+	return b.buildContext(ctx, goos, "arm", strconv.Itoa(goarm), output, false, nil, args...)
 }
 
 // BuildStatic does the same thing Build but the output is a static executable. Assumes
-// the Go standard library was built with CGO_ENABLED=0.
+// the Go standard library was built with CGO_ENABLED=0. It is equivalent to
+// BuildStaticContext with context.Background().
 func (b *Builder) BuildStatic(goos, goarch, output string, args ...string) error {
-	return b.build(goos, goarch, "", output, true, args...)
+	return b.BuildStaticContext(context.Background(), goos, goarch, output, args...)
+}
+
+// BuildStaticContext is BuildStatic with a context for cancellation.
+func (b *Builder) BuildStaticContext(ctx context.Context, goos, goarch, output string, args ...string) error {
+	return b.buildContext(ctx, goos, goarch, "", output, true, nil, args...)
 }
 
 // BuildStaticARM does the same thing BuildARM but the output is a static executable, assuming
-// the Go standard library was built with CGO_ENABLED=0.
+// the Go standard library was built with CGO_ENABLED=0. It is equivalent to
+// BuildStaticARMContext with context.Background().
 func (b *Builder) BuildStaticARM(goos string, goarm int, output string, args ...string) error {
-	return b.build(goos, "arm", strconv.Itoa(goarm), output, true, args...)
+	return b.BuildStaticARMContext(context.Background(), goos, goarm, output, args...)
+}
+
+// BuildStaticARMContext is BuildStaticARM with a context for cancellation.
+func (b *Builder) BuildStaticARMContext(ctx context.Context, goos string, goarm int, output string, args ...string) error {
+	return b.buildContext(ctx, goos, "arm", strconv.Itoa(goarm), output, true, nil, args...)
 }
 
-func (b *Builder) build(goos, goarch, goarm, output string, static bool, args ...string) error {
+// buildContext is the shared implementation behind Build*Context and the
+// per-target workers of BuildMatrixStream. extraEnv lets a single target
+// in a matrix override environment variables (e.g. CGO flags) without
+// affecting the rest of the matrix.
+func (b *Builder) buildContext(ctx context.Context, goos, goarch, goarm, output string, static bool, extraEnv []string, args ...string) error {
 	if !b.ready {
 		return errors.New("not set up")
 	}
@@ -274,26 +504,73 @@ func (b *Builder) build(goos, goarch, goarm, output string, static bool, args ..
 	if err != nil {
 		return err
 	}
+
+	key := b.cacheKey(goos, goarch, goarm, static, args, extraEnv)
+	cached := filepath.Join(b.cacheDir, key)
+	if fileExists(cached) {
+		if err := os.MkdirAll(filepath.Dir(destination), os.FileMode(0700)); err != nil {
+			return err
+		}
+		return linkOrCopy(cached, destination)
+	}
+
 	cmdName := "go"
 	cmdArgs := append([]string{"build", "-o", destination}, args...)
 	if b.CommandName != "" {
 		cmdName = b.CommandName
 		cmdArgs = append(append(b.CommandArgs, destination), args...)
+	} else if b.Reproducible {
+		cmdArgs = append(cmdArgs, b.reproducibleArgs()...)
 	}
-	cmd := exec.Command(cmdName, cmdArgs...)
+	cmd := exec.CommandContext(ctx, cmdName, cmdArgs...)
 	cmd.Dir = path.Join(b.repoCopy, b.SubPackage)
 	errBuf := new(bytes.Buffer)
 	cmd.Stderr = errBuf
-	cmd.Env = append(b.env, "GOOS="+goos, "GOARCH="+goarch, "GOARM="+goarm)
+	env := append(Env(nil), b.env...)
+	cmd.Env = append(env, "GOOS="+goos, "GOARCH="+goarch, "GOARM="+goarm, "GOCACHE="+b.goCacheDir)
 	if static {
 		cmd.Env = append(cmd.Env, "CGO_ENABLED=0")
 	}
+	cmd.Env = append(cmd.Env, extraEnv...)
 	if err := cmd.Run(); err != nil {
 		return errorFmt(cmd, err, errBuf)
 	}
+
+	// Populate the cache for next time. A failure here shouldn't fail
+	// an otherwise successful build.
+	if err := os.MkdirAll(filepath.Dir(cached), os.FileMode(0700)); err == nil {
+		linkOrCopy(destination, cached)
+	}
+
 	return nil
 }
 
+// reproducibleArgs returns the extra `go build` args needed for a
+// reproducible build: -trimpath always, -buildvcs=false unless the repo
+// copy is itself a VCS checkout, and -ldflags "-buildid=..." if BuildID
+// is pinned.
+func (b *Builder) reproducibleArgs() []string {
+	args := []string{"-trimpath"}
+	if !isVCSCheckout(b.repoCopy) {
+		args = append(args, "-buildvcs=false")
+	}
+	if b.BuildID != "" {
+		args = append(args, "-ldflags", "-buildid="+b.BuildID)
+	}
+	return args
+}
+
+// isVCSCheckout reports whether dir looks like the root of a VCS
+// checkout.
+func isVCSCheckout(dir string) bool {
+	for _, vcsDir := range []string{".git", ".hg", ".svn", ".bzr"} {
+		if info, err := os.Stat(filepath.Join(dir, vcsDir)); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
 // SetImportPath moves the source directory to a path corresponding to
 // importPath in GOPATH at runtime.
 // Should be set if source directory contains subpackages.
@@ -318,16 +595,38 @@ func (b *Builder) baseImportPath(importPath string) string {
 }
 
 // RewriteImportsFrom rewrites import path from importPath to a path relative to
-// the source directory at runtime.
+// the source directory at runtime. It is equivalent to RewriteImportsFromContext
+// with context.Background().
 func (b *Builder) RewriteImportsFrom(importPath string) error {
+	return b.RewriteImportsFromContext(context.Background(), importPath)
+}
+
+// RewriteImportsFromContext is RewriteImportsFrom with a context for
+// cancellation.
+func (b *Builder) RewriteImportsFromContext(ctx context.Context, importPath string) error {
 	newPath := filepath.Base(b.repoCopy)
-	return b.RewriteImports(importPath, newPath)
+	return b.RewriteImportsContext(ctx, importPath, newPath)
 }
 
 // RewriteImports rewrites import paths equal to or prefixed with oldPath
-// for source directory and subpackages from oldPath to newPath
+// for source directory and subpackages from oldPath to newPath. It is
+// equivalent to RewriteImportsContext with context.Background().
 func (b *Builder) RewriteImports(oldPath, newPath string) error {
+	return b.RewriteImportsContext(context.Background(), oldPath, newPath)
+}
+
+// RewriteImportsContext is RewriteImports with a context for
+// cancellation, checked between files.
+func (b *Builder) RewriteImportsContext(ctx context.Context, oldPath, newPath string) error {
 	return filepath.Walk(b.repoCopy, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		if info.IsDir() && strings.HasPrefix(info.Name(), ".") {
 			return filepath.SkipDir
 		}
@@ -366,14 +665,28 @@ func rewritePath(file, oldPath, newPath string) error {
 
 // DeepCopy makes a deep file copy of src into dest, overwriting any existing files.
 // If an error occurs, not all files were copied successfully. This function blocks.
-// Hidden/system/nameless files are skipped.
+// Hidden/system/nameless files are skipped. It is equivalent to DeepCopyContext
+// with context.Background().
 func DeepCopy(src string, dest string) error {
+	return DeepCopyContext(context.Background(), src, dest)
+}
+
+// DeepCopyContext is DeepCopy with a context for cancellation, checked
+// between files so a cancelled copy of a large tree doesn't run to
+// completion before giving up.
+func DeepCopyContext(ctx context.Context, src string, dest string) error {
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		// error accessing current file
 		if err != nil {
 			return err
 		}
 
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
 		// don't copy hidden/system files or files without a name.
 		if info.Name() == "" || info.Name()[0] == '.' {
 			if info.IsDir() {
@@ -423,10 +736,50 @@ func DeepCopy(src string, dest string) error {
 		if err = fdest.Close(); err != nil {
 			return err
 		}
+
+		return nil
+	})
+}
+
+// normalizeMtimes sets every regular file in the repo copy to the mtime
+// given by the SOURCE_DATE_EPOCH environment variable
+// (https://reproducible-builds.org/specs/source-date-epoch/), if set, so
+// repeated builds of the same source are byte-for-byte identical
+// regardless of when or where they ran. Only called when Reproducible
+// is set: SOURCE_DATE_EPOCH is commonly present ambient-wide in
+// Nix/Debian/Bazel-style reproducible-build CI for unrelated tooling,
+// and callers who didn't opt into Reproducible shouldn't have DeepCopy's
+// behavior change under them because of it.
+func (b *Builder) normalizeMtimes() error {
+	epoch, ok := sourceDateEpoch()
+	if !ok {
 		return nil
+	}
+	return filepath.Walk(b.repoCopy, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return os.Chtimes(path, epoch, epoch)
 	})
 }
 
+// sourceDateEpoch parses the SOURCE_DATE_EPOCH environment variable, if
+// set, as a Unix timestamp.
+func sourceDateEpoch() (time.Time, bool) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
 // validateSrc validates if src is a valid source directory. If the directory
 // is not present, it checks GOPATH for the package.
 // It returns the absolute path to the src directory if found.
@@ -443,6 +796,12 @@ func validateSrc(env Env, src string) (string, error) {
 	return "", fmt.Errorf("Invalid source directory")
 }
 
+// fileExists reports whether path exists and is a regular file.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
 // absFromGoPath fetches the absolute path to repo in GOPATH.
 // It returns the path if found and an empty string otherwise.
 func absFromGoPath(gopath string, repo string) string {
@@ -494,6 +853,11 @@ func (e Env) Get(key string) string {
 // packages that are needed as dependencies.
 type CodeGenFunc func(sourceDir string, packages []string) error
 
+// CodeGenFuncV2 is a CodeGenFunc that mutates the build through a
+// *codegen.GenContext instead of being handed the raw source directory.
+// See the codegen package for what it can express.
+type CodeGenFuncV2 func(ctx *codegen.GenContext) error
+
 // defaultGoGetTimeout is the duration that `go get -u` is allowed
 // to run, on average, per package.
 const defaultGoGetTimeout = 30 * time.Second
@@ -0,0 +1,165 @@
+package custombuild
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// initCache resolves the cache directory and shared GOCACHE, then
+// computes the source-side component of the build cache key. It must
+// run after the repo copy has been mutated by Generator and its
+// dependencies resolved, since both factor into the key: origHash is
+// the hash of RepoPath taken before any of that happened.
+func (b *Builder) initCache(origHash string) error {
+	cacheRoot := b.CacheDir
+	if cacheRoot == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		cacheRoot = filepath.Join(userCache, "custombuild")
+	}
+	b.cacheDir = filepath.Join(cacheRoot, "bin")
+	b.goCacheDir = filepath.Join(cacheRoot, "gocache")
+	if err := os.MkdirAll(b.cacheDir, os.FileMode(0700)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.goCacheDir, os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	mutatedHash, err := hashTree(b.repoCopy)
+	if err != nil {
+		return err
+	}
+	versions, err := b.moduleVersions()
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "repo:%s\n", origHash)
+	fmt.Fprintf(h, "packages:%s\n", strings.Join(b.Packages, ","))
+	fmt.Fprintf(h, "versions:%s\n", versions)
+	fmt.Fprintf(h, "mutated:%s\n", mutatedHash)
+	b.sourceHash = hex.EncodeToString(h.Sum(nil))
+
+	return nil
+}
+
+// moduleVersions returns the resolved dependency versions for a
+// modules-mode repo copy, as reported by `go list -m all`. It is folded
+// into the cache key so a change in resolved versions, even without a
+// source change, invalidates the cache.
+func (b *Builder) moduleVersions() (string, error) {
+	if !b.modules {
+		return "", nil
+	}
+	cmd := exec.Command("go", "list", "-m", "all")
+	cmd.Dir = b.repoCopy
+	cmd.Env = b.env
+	out, err := cmd.Output()
+	if err != nil {
+		// Best-effort: don't fail the whole build over a cache-key
+		// component we can't resolve (e.g. no main module requirements
+		// yet). The cache will simply miss more than it needs to.
+		return "", nil
+	}
+	return string(out), nil
+}
+
+// cacheKey returns the on-disk cache key for a build of the given
+// target tuple, derived from sourceHash. extraEnv is a target's
+// per-build environment overrides (e.g. CGO flags); its order doesn't
+// matter, but the set must, so it's sorted before hashing.
+func (b *Builder) cacheKey(goos, goarch, goarm string, static bool, args, extraEnv []string) string {
+	sortedEnv := append([]string(nil), extraEnv...)
+	sort.Strings(sortedEnv)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "source:%s\n", b.sourceHash)
+	fmt.Fprintf(h, "target:%s/%s/%s static=%t args=%s env=%s\n", goos, goarch, goarm, static, strings.Join(args, " "), strings.Join(sortedEnv, " "))
+	fmt.Fprintf(h, "reproducible=%t buildid=%s\n", b.Reproducible, b.BuildID)
+	fmt.Fprintf(h, "subpackage=%s command=%s args=%s\n", b.SubPackage, b.CommandName, strings.Join(b.CommandArgs, " "))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashTree computes a stable hash of the contents of every non-hidden
+// regular file under root, visited in lexical order of their full paths.
+// It's used to detect when a source tree (original or post-Generator)
+// has changed since the last build.
+func hashTree(root string) (string, error) {
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() == "" || info.Name()[0] == '.' {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(h, "file:%s\n", strings.TrimPrefix(p, root))
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkOrCopy hardlinks src to dst, falling back to a full copy if
+// hardlinking isn't possible (e.g. src and dst are on different
+// filesystems). Any existing file at dst is replaced.
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	fsrc, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fsrc.Close()
+
+	info, err := fsrc.Stat()
+	if err != nil {
+		return err
+	}
+
+	fdst, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode()&os.ModePerm|0700)
+	if err != nil {
+		return err
+	}
+	defer fdst.Close()
+
+	_, err = io.Copy(fdst, fsrc)
+	return err
+}
@@ -0,0 +1,59 @@
+package custombuild
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkOrCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := linkOrCopy(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+// TestBuildContextCacheHitCreatesOutputDir exercises the cache-hit path of
+// buildContext with the destination's parent directory missing, which used
+// to fail with ENOENT instead of creating it.
+func TestBuildContextCacheHitCreatesOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Builder{ready: true, cacheDir: cacheDir, sourceHash: "abc123"}
+	key := b.cacheKey("linux", "amd64", "", false, nil, nil)
+	if err := os.WriteFile(filepath.Join(cacheDir, key), []byte("binary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "nested", "does", "not", "exist", "app")
+	if err := b.buildContext(context.Background(), "linux", "amd64", "", output, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "binary" {
+		t.Errorf("got %q, want %q", got, "binary")
+	}
+}
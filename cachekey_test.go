@@ -0,0 +1,23 @@
+package custombuild
+
+import "testing"
+
+func TestCacheKeyStableRegardlessOfExtraEnvOrder(t *testing.T) {
+	b := &Builder{sourceHash: "abc123"}
+
+	k1 := b.cacheKey("linux", "amd64", "", false, []string{"-tags", "foo"}, []string{"FOO=1", "BAR=2"})
+	k2 := b.cacheKey("linux", "amd64", "", false, []string{"-tags", "foo"}, []string{"BAR=2", "FOO=1"})
+	if k1 != k2 {
+		t.Errorf("cacheKey should be stable regardless of extraEnv order, got %q and %q", k1, k2)
+	}
+}
+
+func TestCacheKeyVariesWithExtraEnv(t *testing.T) {
+	b := &Builder{sourceHash: "abc123"}
+
+	k1 := b.cacheKey("linux", "amd64", "", false, nil, []string{"CGO_ENABLED=1"})
+	k2 := b.cacheKey("linux", "amd64", "", false, nil, []string{"CGO_ENABLED=0"})
+	if k1 == k2 {
+		t.Error("cacheKey should differ when extraEnv differs, so builds with different env overrides don't collide in the cache")
+	}
+}
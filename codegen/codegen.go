@@ -0,0 +1,275 @@
+// Package codegen provides helpers for custombuild's Generator funcs that
+// need to inject files and code into the copied repository, in particular
+// Go 1.16+ //go:embed directives. It exists so a generator can express its
+// mutations declaratively (AddImport, EmbedFile, AppendInit) instead of
+// hand-rolling go/ast and astutil calls for the common cases.
+package codegen
+
+import (
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// generatedFileName is the name of the .go file Flush writes into each
+// package directory that has pending imports, embeds, or init statements.
+const generatedFileName = "zz_generated_custombuild.go"
+
+// GenContext is passed to a CodeGenFuncV2. It carries the repo copy's
+// root directory and the dependency packages for this build, and
+// accumulates pending mutations until Flush writes them out as generated
+// .go files. pkg in AddImport/EmbedFile/AppendInit is a directory path
+// relative to SourceDir identifying which package the mutation targets.
+type GenContext struct {
+	// SourceDir is the root of the (copied) repository being mutated.
+	SourceDir string
+
+	// Packages is the list of dependency packages this build requested.
+	Packages []string
+
+	imports map[string][]string
+	inits   map[string][]string
+	embeds  map[string]map[string][]embedFile // pkg -> FS var -> files
+}
+
+type embedFile struct {
+	virtualPath string
+	data        []byte
+}
+
+// NewGenContext creates a GenContext for a single Generator invocation.
+func NewGenContext(sourceDir string, packages []string) *GenContext {
+	return &GenContext{
+		SourceDir: sourceDir,
+		Packages:  packages,
+		imports:   make(map[string][]string),
+		inits:     make(map[string][]string),
+		embeds:    make(map[string]map[string][]embedFile),
+	}
+}
+
+// AddImport registers path to be imported by the generated file for pkg.
+// If no AppendInit statement for pkg references it, Flush emits it as a
+// blank import (`_ "path"`) instead, so a side-effect-only import (e.g.
+// registering configuration or assets) doesn't fail the build with
+// "imported and not used".
+func (c *GenContext) AddImport(pkg, path string) {
+	c.imports[pkg] = append(c.imports[pkg], path)
+}
+
+// AppendInit registers stmt, a single Go statement, to run inside the
+// generated file's init() function for pkg.
+func (c *GenContext) AppendInit(pkg, stmt string) {
+	c.inits[pkg] = append(c.inits[pkg], stmt)
+}
+
+// EmbedFile writes data to virtualPath inside pkg's directory and
+// registers virtualPath as a //go:embed pattern on the caller-specified
+// embed.FS variable varName, declared in the generated file for pkg.
+// virtualPath may carry the "all:" prefix go:embed recognizes; patterns
+// that would otherwise silently skip a "."/"_"-prefixed path element are
+// rejected rather than embedding nothing.
+func (c *GenContext) EmbedFile(pkg, varName, virtualPath string, data []byte) error {
+	if err := validateEmbedPattern(virtualPath); err != nil {
+		return err
+	}
+
+	full := filepath.Join(c.SourceDir, pkg, strings.TrimPrefix(virtualPath, "all:"))
+	if err := os.MkdirAll(filepath.Dir(full), os.FileMode(0700)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(full, data, os.FileMode(0600)); err != nil {
+		return err
+	}
+
+	if c.embeds[pkg] == nil {
+		c.embeds[pkg] = make(map[string][]embedFile)
+	}
+	c.embeds[pkg][varName] = append(c.embeds[pkg][varName], embedFile{virtualPath: virtualPath, data: data})
+	return nil
+}
+
+// validateEmbedPattern checks pattern against the rule the compiler
+// applies to //go:embed patterns: without an "all:" prefix, a pattern
+// silently skips any path element beginning with "." or "_", which would
+// make EmbedFile write a file that never ends up in the embed.FS.
+func validateEmbedPattern(pattern string) error {
+	rest := strings.TrimPrefix(pattern, "all:")
+	hasAll := rest != pattern
+	for _, part := range strings.Split(rest, "/") {
+		if part == "" {
+			continue
+		}
+		if (part[0] == '.' || part[0] == '_') && !hasAll {
+			return fmt.Errorf("codegen: embed pattern %q contains the dot/underscore-prefixed element %q, which go:embed silently skips unless the pattern is prefixed with \"all:\"", pattern, part)
+		}
+	}
+	return nil
+}
+
+// Flush writes one generated .go file per package with pending
+// mutations. Call it once, after the Generator is done calling AddImport/
+// EmbedFile/AppendInit.
+func (c *GenContext) Flush() error {
+	pkgs := make(map[string]bool)
+	for pkg := range c.imports {
+		pkgs[pkg] = true
+	}
+	for pkg := range c.inits {
+		pkgs[pkg] = true
+	}
+	for pkg := range c.embeds {
+		pkgs[pkg] = true
+	}
+
+	names := make([]string, 0, len(pkgs))
+	for pkg := range pkgs {
+		names = append(names, pkg)
+	}
+	sort.Strings(names)
+
+	for _, pkg := range names {
+		if err := c.flushPackage(pkg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *GenContext) flushPackage(pkg string) error {
+	dir := filepath.Join(c.SourceDir, pkg)
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	name, err := packageName(dir)
+	if err != nil {
+		return err
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "// Code generated by custombuild/codegen. DO NOT EDIT.\n\npackage %s\n\n", name)
+
+	imports := dedupe(c.imports[pkg])
+	sort.Strings(imports)
+	var used, unused []string
+	for _, imp := range imports {
+		if importReferenced(imp, c.inits[pkg]) {
+			used = append(used, imp)
+		} else {
+			unused = append(unused, imp)
+		}
+	}
+	if len(c.embeds[pkg]) > 0 {
+		used = append(used, "embed")
+		sort.Strings(used)
+	}
+	if len(used) > 0 || len(unused) > 0 {
+		buf.WriteString("import (\n")
+		for _, imp := range used {
+			fmt.Fprintf(&buf, "\t%q\n", imp)
+		}
+		for _, imp := range unused {
+			fmt.Fprintf(&buf, "\t_ %q\n", imp)
+		}
+		buf.WriteString(")\n\n")
+	}
+
+	varNames := make([]string, 0, len(c.embeds[pkg]))
+	for varName := range c.embeds[pkg] {
+		varNames = append(varNames, varName)
+	}
+	sort.Strings(varNames)
+	for _, varName := range varNames {
+		var patterns []string
+		for _, f := range c.embeds[pkg][varName] {
+			patterns = append(patterns, f.virtualPath)
+		}
+		patterns = dedupe(patterns)
+		sort.Strings(patterns)
+		fmt.Fprintf(&buf, "//go:embed %s\nvar %s embed.FS\n\n", strings.Join(patterns, " "), varName)
+	}
+
+	if stmts := c.inits[pkg]; len(stmts) > 0 {
+		buf.WriteString("func init() {\n")
+		for _, stmt := range stmts {
+			fmt.Fprintf(&buf, "\t%s\n", stmt)
+		}
+		buf.WriteString("}\n")
+	}
+
+	src, err := format.Source([]byte(buf.String()))
+	if err != nil {
+		return fmt.Errorf("codegen: generated invalid Go for package %q: %w", pkg, err)
+	}
+
+	return os.WriteFile(filepath.Join(dir, generatedFileName), src, os.FileMode(0600))
+}
+
+// packageName returns the package name of the Go files already in dir,
+// falling back to a sanitized form of the directory's base name if dir
+// has none yet (e.g. it's a brand new package).
+func packageName(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	fset := token.NewFileSet()
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".go") || e.Name() == generatedFileName {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, e.Name()), nil, parser.PackageClauseOnly)
+		if err != nil {
+			continue
+		}
+		return f.Name.Name, nil
+	}
+
+	return sanitizeIdent(filepath.Base(dir)), nil
+}
+
+// importReferenced reports whether any of stmts (a package's AppendInit
+// statements) references path's package identifier, approximated as the
+// last element of path the same way packageName falls back for a brand
+// new package.
+func importReferenced(path string, stmts []string) bool {
+	ident := sanitizeIdent(filepath.Base(path)) + "."
+	for _, stmt := range stmts {
+		if strings.Contains(stmt, ident) {
+			return true
+		}
+	}
+	return false
+}
+
+func sanitizeIdent(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		return "main"
+	}
+	return name
+}
+
+func dedupe(in []string) []string {
+	seen := make(map[string]bool, len(in))
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
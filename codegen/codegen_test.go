@@ -0,0 +1,73 @@
+package codegen
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlushEmbedAndInit(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "assets", "main.go"), []byte("package assets\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewGenContext(dir, []string{"example.com/foo"})
+	ctx.AddImport("assets", "example.com/foo")
+	if err := ctx.EmbedFile("assets", "Files", "static/a.txt", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	ctx.AppendInit("assets", "foo.Register()")
+
+	if err := ctx.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "assets", "zz_generated_custombuild.go")); err != nil {
+		t.Fatalf("generated file missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "assets", "static", "a.txt")); err != nil {
+		t.Fatalf("embedded file missing: %v", err)
+	}
+}
+
+func TestFlushBlankImportsUnreferencedAddImport(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "plugins"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "plugins", "main.go"), []byte("package plugins\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewGenContext(dir, []string{"example.com/sideeffect"})
+	ctx.AddImport("plugins", "example.com/sideeffect")
+
+	if err := ctx.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	generated, err := os.ReadFile(filepath.Join(dir, "plugins", "zz_generated_custombuild.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(generated), `_ "example.com/sideeffect"`) {
+		t.Errorf("expected a blank import for an AddImport with no referencing AppendInit, got:\n%s", generated)
+	}
+}
+
+func TestEmbedFileRejectsHiddenPattern(t *testing.T) {
+	dir := t.TempDir()
+	ctx := NewGenContext(dir, nil)
+
+	if err := ctx.EmbedFile("pkg", "Files", "static/.secret", []byte("x")); err == nil {
+		t.Fatal("expected error for a hidden path element without an \"all:\" prefix")
+	}
+	if err := ctx.EmbedFile("pkg", "Files", "all:static/.secret", []byte("x")); err != nil {
+		t.Fatalf("\"all:\" prefix should be accepted: %v", err)
+	}
+}
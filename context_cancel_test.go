@@ -0,0 +1,49 @@
+package custombuild
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSetupContextCancellation confirms a cancelled context aborts
+// SetupContext instead of running the repo copy/dependency resolution to
+// completion.
+func TestSetupContextCancellation(t *testing.T) {
+	repo := t.TempDir()
+	if err := os.WriteFile(filepath.Join(repo, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "go.mod"), []byte("module setupcanceltest\n\ngo 1.20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewUnready(repo, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.SetupContext(ctx); err == nil {
+		t.Fatal("expected an error from SetupContext against an already-cancelled context")
+	}
+}
+
+// TestGoGetContextCancellation confirms a cancelled context stops
+// goGetContext's `go get` subprocess rather than letting it run.
+func TestGoGetContextCancellation(t *testing.T) {
+	b, err := NewUnready(t.TempDir(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.goGetContext(ctx, []string{"example.com/some/pkg"}); err == nil {
+		t.Fatal("expected an error from goGetContext against an already-cancelled context")
+	}
+}
@@ -0,0 +1,148 @@
+package custombuild
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Target describes one entry in a cross-compilation matrix: a GOOS/
+// GOARCH pair, the GOARM version to use when GOARCH is "arm", whether
+// to produce a static executable, and any build args or environment
+// overrides specific to this target.
+type Target struct {
+	GOOS   string
+	GOARCH string
+	GOARM  int
+	Static bool
+	Args   []string
+	Env    []string
+}
+
+// MatrixResult is the outcome of building a single Target as part of a
+// BuildMatrix/BuildMatrixStream call.
+type MatrixResult struct {
+	Target Target
+	Output string
+	Err    error
+}
+
+// MatrixError aggregates the per-target failures from a BuildMatrix
+// call. Building some targets can succeed even when others fail, so a
+// failing target does not abort the rest of the matrix.
+type MatrixError struct {
+	Failed []MatrixResult
+	Total  int
+}
+
+func (e *MatrixError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, r := range e.Failed {
+		msgs[i] = fmt.Sprintf("%s/%s: %v", r.Target.GOOS, r.Target.GOARCH, r.Err)
+	}
+	return fmt.Sprintf("%d of %d targets failed:\n%s", len(e.Failed), e.Total, strings.Join(msgs, "\n"))
+}
+
+// BuildMatrix builds every target in the matrix, fanning the builds out
+// across a bounded worker pool, and blocks until all of them are done.
+// outputPattern is a text/template string rendered per target, exposing
+// {{.GOOS}}, {{.GOARCH}} and {{.GOARM}} (e.g. "dist/{{.GOOS}}/{{.GOARCH}}/app").
+// It returns a *MatrixError if any target failed.
+func (b *Builder) BuildMatrix(targets []Target, outputPattern string) error {
+	return b.BuildMatrixContext(context.Background(), targets, outputPattern)
+}
+
+// BuildMatrixContext is BuildMatrix with a context for cancellation.
+// Cancelling ctx stops any targets not yet started and kills the
+// subprocess of any target currently building.
+func (b *Builder) BuildMatrixContext(ctx context.Context, targets []Target, outputPattern string) error {
+	var failed []MatrixResult
+	for res := range b.BuildMatrixStream(ctx, targets, outputPattern) {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	if len(failed) > 0 {
+		return &MatrixError{Failed: failed, Total: len(targets)}
+	}
+	return nil
+}
+
+// BuildMatrixStream is the streaming variant of BuildMatrixContext. It
+// fans the targets out across a worker pool of runtime.NumCPU() workers
+// (the pool size is not configurable) and returns a channel that receives one MatrixResult
+// per target as it completes. The channel is closed once every target
+// has been attempted.
+func (b *Builder) BuildMatrixStream(ctx context.Context, targets []Target, outputPattern string) <-chan MatrixResult {
+	results := make(chan MatrixResult)
+	tmpl, tmplErr := template.New("output").Parse(outputPattern)
+
+	go func() {
+		defer close(results)
+
+		if tmplErr != nil {
+			for _, t := range targets {
+				results <- MatrixResult{Target: t, Err: tmplErr}
+			}
+			return
+		}
+
+		workers := runtime.NumCPU()
+		if workers < 1 {
+			workers = 1
+		}
+		sem := make(chan struct{}, workers)
+		var wg sync.WaitGroup
+
+		for _, t := range targets {
+			select {
+			case <-ctx.Done():
+				results <- MatrixResult{Target: t, Err: ctx.Err()}
+				continue
+			default:
+			}
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(t Target) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				output, err := b.buildTarget(ctx, t, tmpl)
+				results <- MatrixResult{Target: t, Output: output, Err: err}
+			}(t)
+		}
+
+		wg.Wait()
+	}()
+
+	return results
+}
+
+// buildTarget renders outputPattern for t and runs the equivalent of
+// Build/BuildARM/BuildStatic*/BuildStaticARM for it, returning the
+// rendered output path.
+func (b *Builder) buildTarget(ctx context.Context, t Target, tmpl *template.Template) (string, error) {
+	var buf bytes.Buffer
+	data := struct {
+		GOOS, GOARCH string
+		GOARM        int
+	}{t.GOOS, t.GOARCH, t.GOARM}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	output := buf.String()
+
+	goarm := ""
+	if t.GOARCH == "arm" && t.GOARM != 0 {
+		goarm = strconv.Itoa(t.GOARM)
+	}
+
+	err := b.buildContext(ctx, t.GOOS, t.GOARCH, goarm, output, t.Static, t.Env, t.Args...)
+	return output, err
+}
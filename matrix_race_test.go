@@ -0,0 +1,64 @@
+package custombuild
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestBuildContextConcurrentEnvIsolation builds two targets concurrently
+// against a Builder whose env slice has spare capacity (as Env.Set leaves
+// it after Setup), the way BuildMatrixStream's worker pool does. Run with
+// -race: before buildContext copied b.env per call, concurrent workers
+// aliased the same backing array and raced on GOOS/GOARCH/GOARM writes.
+func TestBuildContextConcurrentEnvIsolation(t *testing.T) {
+	repo := t.TempDir()
+	mainSrc := "package main\n\nfunc main() {}\n"
+	if err := os.WriteFile(filepath.Join(repo, "main.go"), []byte(mainSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "go.mod"), []byte("module matrixracetest\n\ngo 1.20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := t.TempDir()
+	env := make(Env, len(os.Environ()), len(os.Environ())+8)
+	copy(env, os.Environ())
+
+	b := &Builder{
+		ready:       true,
+		repoCopy:    repo,
+		cacheDir:    filepath.Join(cacheDir, "bin"),
+		goCacheDir:  filepath.Join(cacheDir, "gocache"),
+		env:         env,
+		CommandName: "true",
+	}
+
+	dist := t.TempDir()
+	targets := []Target{
+		{GOOS: "linux", GOARCH: "amd64"},
+		{GOOS: "linux", GOARCH: "arm64"},
+	}
+
+	for i := 0; i < 20; i++ {
+		var wg sync.WaitGroup
+		var start sync.WaitGroup
+		start.Add(1)
+		for _, target := range targets {
+			target := target
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start.Wait()
+				output := filepath.Join(dist, target.GOOS+"_"+target.GOARCH, "app", string(rune('0'+i)))
+				if err := b.buildContext(context.Background(), target.GOOS, target.GOARCH, "", output, false, nil); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		start.Done()
+		wg.Wait()
+	}
+}
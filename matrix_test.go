@@ -0,0 +1,69 @@
+package custombuild
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func testMatrixBuilder(t *testing.T) *Builder {
+	t.Helper()
+
+	repo := t.TempDir()
+	mainSrc := "package main\n\nfunc main() {}\n"
+	if err := os.WriteFile(filepath.Join(repo, "main.go"), []byte(mainSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "go.mod"), []byte("module matrixtest\n\ngo 1.20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := t.TempDir()
+	return &Builder{
+		ready:      true,
+		repoCopy:   repo,
+		cacheDir:   filepath.Join(cacheDir, "bin"),
+		goCacheDir: filepath.Join(cacheDir, "gocache"),
+		env:        Env(os.Environ()),
+	}
+}
+
+func TestBuildMatrix(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	b := testMatrixBuilder(t)
+	dist := t.TempDir()
+
+	targets := []Target{
+		{GOOS: "linux", GOARCH: "amd64"},
+		{GOOS: "linux", GOARCH: "arm64"},
+	}
+
+	if err := b.BuildMatrix(targets, filepath.Join(dist, "{{.GOOS}}_{{.GOARCH}}", "app")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range targets {
+		out := filepath.Join(dist, target.GOOS+"_"+target.GOARCH, "app")
+		if _, err := os.Stat(out); err != nil {
+			t.Errorf("expected output for %s/%s at %s: %v", target.GOOS, target.GOARCH, out, err)
+		}
+	}
+}
+
+func TestBuildMatrixStreamRespectsCancellation(t *testing.T) {
+	b := testMatrixBuilder(t)
+	dist := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := b.BuildMatrixContext(ctx, []Target{{GOOS: "linux", GOARCH: "amd64"}}, filepath.Join(dist, "app"))
+	if err == nil {
+		t.Fatal("expected an error from a matrix built against an already-cancelled context")
+	}
+}
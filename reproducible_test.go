@@ -0,0 +1,56 @@
+package custombuild
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeepCopyDoesNotNormalizeMtimes(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "file.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1000000000")
+
+	dest := t.TempDir()
+	if err := DeepCopy(src, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dest, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Unix() == 1000000000 {
+		t.Error("DeepCopy should not apply SOURCE_DATE_EPOCH; that's normalizeMtimes' job, gated on Builder.Reproducible")
+	}
+}
+
+func TestNormalizeMtimesAppliesSourceDateEpoch(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "1000000000")
+
+	b := &Builder{repoCopy: dir}
+	if err := b.normalizeMtimes(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().Unix() != 1000000000 {
+		t.Errorf("got mtime %d, want 1000000000", info.ModTime().Unix())
+	}
+}
@@ -0,0 +1,46 @@
+package custombuild
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestSetupModulesForcedWithoutGoMod exercises Modules=true against a repo
+// that has no go.mod of its own: Setup must run `go mod init` in the copy
+// before resolving dependencies, rather than failing with "no modules
+// specified".
+func TestSetupModulesForcedWithoutGoMod(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	repo := t.TempDir()
+	mainSrc := "package main\n\nfunc main() {}\n"
+	if err := os.WriteFile(filepath.Join(repo, "main.go"), []byte(mainSrc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewUnready(repo, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Modules = true
+	b.ModulePath = "example.com/setuptest"
+
+	if err := b.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Teardown()
+
+	if _, err := os.Stat(filepath.Join(b.repoCopy, "go.mod")); err != nil {
+		t.Fatalf("expected go.mod to be created in the repo copy: %v", err)
+	}
+
+	cmd := exec.Command("go", "build", "./...")
+	cmd.Dir = b.repoCopy
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build in repo copy failed: %v\n%s", err, out)
+	}
+}